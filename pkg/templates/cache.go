@@ -0,0 +1,117 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package templates
+
+import (
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// cacheRepresentation discriminates cacheKey entries by the concrete Go type a fetch stores in
+// the cache, since fromSecret/fromConfigMap (typed client objects) and lookup/fromClusterClaim
+// (dynamic client *unstructured.Unstructured) can otherwise collide on the same GVK/namespace/name
+// while caching incompatible types.
+type cacheRepresentation int
+
+const (
+	typedRepresentation cacheRepresentation = iota
+	unstructuredRepresentation
+)
+
+// cacheKey uniquely identifies a single Kubernetes API object for the purposes of the resource
+// cache. representation is included so that a typed fetch (fromSecret, fromConfigMap) and an
+// unstructured fetch (lookup, fromClusterClaim) for the same GVK/namespace/name are never confused
+// for each other.
+type cacheKey struct {
+	gvk            schema.GroupVersionKind
+	namespace      string
+	name           string
+	representation cacheRepresentation
+}
+
+// cacheEntry stores the result of a single API fetch. A non-nil err is cached just like a
+// successful result so that a NotFound is remembered instead of re-hitting the API server on every
+// reference to the same missing object.
+type cacheEntry struct {
+	obj interface{}
+	err error
+}
+
+// resourceCache is a short-lived, in-memory cache of the objects fetched by fromSecret,
+// fromConfigMap, fromClusterClaim, and lookup. It must be scoped to a single ResolveTemplate call
+// and never stored on the TemplateResolver: the resolver is long-lived and shared, while the
+// correctness of a cached lookup result is only guaranteed for the duration of one template
+// resolution. It's safe for concurrent use in case concurrent template function execution is ever
+// introduced.
+type resourceCache struct {
+	mu      sync.Mutex
+	entries map[cacheKey]cacheEntry
+}
+
+// newResourceCache instantiates an empty resourceCache ready for use.
+func newResourceCache() *resourceCache {
+	return &resourceCache{entries: map[cacheKey]cacheEntry{}}
+}
+
+// get returns the cached entry for the key and whether it was present.
+func (c *resourceCache) get(key cacheKey) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+
+	return entry, ok
+}
+
+// set stores the entry for the key, overwriting any previous value.
+func (c *resourceCache) set(key cacheKey, entry cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = entry
+}
+
+// restMappingEntry stores the result of a single REST mapping resolution. A non-nil err is cached
+// just like a successful mapping so that a missing CRD or core API resource isn't rediscovered on
+// every reference to it.
+type restMappingEntry struct {
+	mapping *meta.RESTMapping
+	err     error
+}
+
+// restMappingCache is a short-lived, in-memory cache of the REST mappings resolved by
+// TemplateResolver.restMapping. Like resourceCache, it must be scoped to a single ResolveTemplate
+// call: a full discovery round-trip is expensive, but a lookup call is often repeated for the same
+// GroupVersionKind within one template, so caching it here avoids paying for discovery more than
+// once per resolution. It's safe for concurrent use in case concurrent template function execution
+// is ever introduced.
+type restMappingCache struct {
+	mu      sync.Mutex
+	entries map[schema.GroupVersionKind]restMappingEntry
+}
+
+// newRESTMappingCache instantiates an empty restMappingCache ready for use.
+func newRESTMappingCache() *restMappingCache {
+	return &restMappingCache{entries: map[schema.GroupVersionKind]restMappingEntry{}}
+}
+
+// get returns the cached entry for gvk and whether it was present.
+func (c *restMappingCache) get(gvk schema.GroupVersionKind) (restMappingEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[gvk]
+
+	return entry, ok
+}
+
+// set stores the entry for gvk, overwriting any previous value.
+func (c *restMappingCache) set(gvk schema.GroupVersionKind, entry restMappingEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[gvk] = entry
+}
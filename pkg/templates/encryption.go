@@ -0,0 +1,140 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package templates
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+// protect encrypts s with the configured AES key and returns it prefixed so that
+// processEncryptedStrs can later detect and decrypt it. When Config.RandomIV is enabled, a fresh
+// initialization vector is generated for this call and prepended to the ciphertext, which avoids
+// identical plaintexts encrypting to identical ciphertexts. Otherwise, the single
+// Config.InitializationVector is reused for every "protect" call.
+func (t *TemplateResolver) protect(s string) (string, error) {
+	iv := t.config.InitializationVector
+
+	if t.config.RandomIV {
+		iv = make([]byte, IVSize)
+		if _, err := rand.Read(iv); err != nil {
+			return "", fmt.Errorf("failed to generate a random initialization vector: %w", err)
+		}
+	}
+
+	ciphertext, err := encryptBytes([]byte(s), t.config.AESKey, iv)
+	if err != nil {
+		return "", err
+	}
+
+	if t.config.RandomIV {
+		return protectedPrefixV2 + base64.StdEncoding.EncodeToString(append(iv, ciphertext...)), nil
+	}
+
+	return protectedPrefix + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// fromSecretProtected returns the encrypted value of key in the Secret named name in namespace. It's
+// registered in place of fromSecret when Config.EncryptionMode is EncryptionEnabled.
+func (tc *templateContext) fromSecretProtected(namespace, name, key string) (string, error) {
+	value, err := tc.fromSecret(namespace, name, key)
+	if err != nil {
+		return "", err
+	}
+
+	return tc.resolver.protect(value)
+}
+
+// decrypt decrypts the base64-encoded payload of an encrypted template value. isRandomIV indicates
+// the payload was produced under Config.RandomIV (i.e. it matched the protectedPrefixV2 format), in
+// which case the first IVSize bytes of the decoded payload are the per-value IV rather than part of
+// the ciphertext.
+func (t *TemplateResolver) decrypt(payload string, isRandomIV bool) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", ErrInvalidB64OfEncrypted
+	}
+
+	iv := t.config.InitializationVector
+	ciphertext := decoded
+
+	if isRandomIV {
+		if len(decoded) < IVSize {
+			return "", ErrInvalidB64OfEncrypted
+		}
+
+		iv, ciphertext = decoded[:IVSize], decoded[IVSize:]
+	}
+
+	plaintext, err := decryptBytes(ciphertext, t.config.AESKey, iv)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// encryptBytes encrypts plaintext with AES-CBC using key and iv, after applying PKCS7 padding.
+func encryptBytes(plaintext, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrInvalidAESKey
+	}
+
+	padded := pkcs7Pad(plaintext, block.BlockSize())
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+	return ciphertext, nil
+}
+
+// decryptBytes decrypts ciphertext with AES-CBC using key and iv, then removes the PKCS7 padding.
+func decryptBytes(ciphertext, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrInvalidAESKey
+	}
+
+	if len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, ErrInvalidPKCS7Padding
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	return pkcs7Unpad(plaintext, block.BlockSize())
+}
+
+// pkcs7Pad pads data to a multiple of blockSize per PKCS#7.
+func pkcs7Pad(data []byte, blockSize int) []byte {
+	padLen := blockSize - len(data)%blockSize
+	padding := bytes.Repeat([]byte{byte(padLen)}, padLen)
+
+	return append(data, padding...)
+}
+
+// pkcs7Unpad removes and validates PKCS#7 padding from data.
+func pkcs7Unpad(data []byte, blockSize int) ([]byte, error) {
+	length := len(data)
+	if length == 0 || length%blockSize != 0 {
+		return nil, ErrInvalidPKCS7Padding
+	}
+
+	padLen := int(data[length-1])
+	if padLen == 0 || padLen > blockSize || padLen > length {
+		return nil, ErrInvalidPKCS7Padding
+	}
+
+	for _, b := range data[length-padLen:] {
+		if int(b) != padLen {
+			return nil, ErrInvalidPKCS7Padding
+		}
+	}
+
+	return data[:length-padLen], nil
+}
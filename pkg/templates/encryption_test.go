@@ -0,0 +1,63 @@
+package templates
+
+import "testing"
+
+func newEncryptionTestResolver(t *testing.T, randomIV bool) *TemplateResolver {
+	t.Helper()
+
+	return &TemplateResolver{
+		config: Config{
+			EncryptionMode:       EncryptionEnabled,
+			AESKey:               []byte("0123456789abcdef"),
+			InitializationVector: []byte("abcdefghijklmnop"),
+			RandomIV:             randomIV,
+		},
+	}
+}
+
+func TestProtectRandomIVProducesDistinctCiphertexts(t *testing.T) {
+	resolver := newEncryptionTestResolver(t, true)
+
+	first, err := resolver.protect("the same secret")
+	if err != nil {
+		t.Fatalf("failed to protect: %v", err)
+	}
+
+	second, err := resolver.protect("the same secret")
+	if err != nil {
+		t.Fatalf("failed to protect: %v", err)
+	}
+
+	if first == second {
+		t.Errorf("expected two protect calls on the same plaintext to produce different ciphertexts, got the same value twice: %s", first)
+	}
+
+	decrypted, err := resolver.decrypt(first[len(protectedPrefixV2):], true)
+	if err != nil {
+		t.Fatalf("failed to decrypt: %v", err)
+	}
+
+	if decrypted != "the same secret" {
+		t.Errorf("expected the decrypted value to round-trip, got %s", decrypted)
+	}
+}
+
+func TestDecryptLegacyFormatUnderRandomIVConfig(t *testing.T) {
+	legacyResolver := newEncryptionTestResolver(t, false)
+
+	legacy, err := legacyResolver.protect("legacy secret")
+	if err != nil {
+		t.Fatalf("failed to protect with the legacy resolver: %v", err)
+	}
+
+	randomIVResolver := newEncryptionTestResolver(t, true)
+
+	decrypted, err := randomIVResolver.decrypt(legacy[len(protectedPrefix):], false)
+	if err != nil {
+		t.Fatalf("failed to decrypt a legacy value with a RandomIV-configured resolver: %v", err)
+	}
+
+	if decrypted != "legacy secret" {
+		t.Errorf("expected legacy secret, got %s", decrypted)
+	}
+}
@@ -0,0 +1,358 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package templates
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
+)
+
+// literalLookupRe builds a regexp that detects literal "lookup" calls (i.e. with quoted apiVersion
+// and kind arguments) inside a template action delimited by startDelim/stopDelim, so that their REST
+// mapping can be resolved up front. A non-literal argument, such as a variable or another template
+// action, is intentionally not matched since its value isn't known until execution. The match is
+// anchored to the configured delimiters (the same approach as processForDataTypes and
+// processForAutoIndent) so that an ordinary data value which merely contains lookup-shaped text,
+// such as a ConfigMap value or a free-form description field, isn't mistaken for a template action.
+func literalLookupRe(startDelim, stopDelim string) *regexp.Regexp {
+	d1 := regexp.QuoteMeta(startDelim)
+	d2 := regexp.QuoteMeta(stopDelim)
+
+	return regexp.MustCompile(d1 + `.*?\blookup\s+"([^"]+)"\s+"([^"]+)".*?` + d2)
+}
+
+// clusterClaimGVK is the GroupVersionKind of the cluster-scoped ClusterClaim API used by
+// fromClusterClaim.
+var clusterClaimGVK = schema.GroupVersionKind{
+	Group: "cluster.open-cluster-management.io", Version: "v1alpha1", Kind: "ClusterClaim",
+}
+
+// templateContext bundles a TemplateResolver with the resourceCache scoped to a single
+// ResolveTemplate call. Its methods, rather than the TemplateResolver methods directly, are what
+// get registered in the function map so that fromSecret, fromConfigMap, fromClusterClaim, and
+// lookup can share a cache without that cache being stored on the long-lived TemplateResolver.
+type templateContext struct {
+	resolver     *TemplateResolver
+	cache        *resourceCache
+	restMappings *restMappingCache
+}
+
+// newTemplateContext creates the templateContext for a single ResolveTemplate call. The resource
+// cache is omitted when Config.DisableResourceCache is set. The REST mapping cache is always
+// created since it only avoids repeating a discovery round-trip within this single call.
+func (t *TemplateResolver) newTemplateContext() *templateContext {
+	tc := &templateContext{resolver: t, restMappings: newRESTMappingCache()}
+
+	if !t.config.DisableResourceCache {
+		tc.cache = newResourceCache()
+	}
+
+	return tc
+}
+
+// restMapping resolves the REST mapping for gvk, caching the result for the rest of this
+// ResolveTemplate call so that a repeated or duplicate literal "lookup" call doesn't pay for
+// rediscovering the Kubernetes API resources more than once.
+func (tc *templateContext) restMapping(gvk schema.GroupVersionKind) (*meta.RESTMapping, error) {
+	if entry, ok := tc.restMappings.get(gvk); ok {
+		return entry.mapping, entry.err
+	}
+
+	mapping, err := tc.resolver.restMapping(gvk)
+	tc.restMappings.set(gvk, restMappingEntry{mapping: mapping, err: err})
+
+	return mapping, err
+}
+
+// getOrFetch returns the cached object for the key if the cache is enabled and already populated.
+// Otherwise, fetch is invoked and its result (including an error, such as a NotFound) is stored
+// for the rest of this ResolveTemplate call before being returned.
+func (tc *templateContext) getOrFetch(key cacheKey, fetch func() (interface{}, error)) (interface{}, error) {
+	if tc.cache == nil {
+		return fetch()
+	}
+
+	if entry, ok := tc.cache.get(key); ok {
+		return entry.obj, entry.err
+	}
+
+	obj, err := fetch()
+	tc.cache.set(key, cacheEntry{obj: obj, err: err})
+
+	return obj, err
+}
+
+// validateLookupNamespace returns ErrRestrictedNamespace if Config.LookupNamespace is set and
+// namespace doesn't match it. An empty LookupNamespace means no restriction is in effect, in which
+// case an empty namespace argument (e.g. for a cluster-scoped lookup) is also allowed through.
+func (t *TemplateResolver) validateLookupNamespace(namespace string) error {
+	if t.config.LookupNamespace == "" {
+		return nil
+	}
+
+	if namespace != t.config.LookupNamespace {
+		return fmt.Errorf("the namespace %q does not match %q: %w", namespace, t.config.LookupNamespace, ErrRestrictedNamespace)
+	}
+
+	return nil
+}
+
+// fromSecret returns the value of key in the Secret named name in namespace.
+func (tc *templateContext) fromSecret(namespace, name, key string) (string, error) {
+	if err := tc.resolver.validateLookupNamespace(namespace); err != nil {
+		return "", err
+	}
+
+	cKey := cacheKey{
+		gvk: corev1.SchemeGroupVersion.WithKind("Secret"), namespace: namespace, name: name,
+		representation: typedRepresentation,
+	}
+
+	obj, err := tc.getOrFetch(cKey, func() (interface{}, error) {
+		kubeClient := *tc.resolver.kubeClient
+
+		return kubeClient.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get the secret %s/%s: %w", namespace, name, classifyAPIResourceErr(err, false))
+	}
+
+	secret, _ := obj.(*corev1.Secret)
+
+	val, ok := secret.Data[key]
+	if !ok {
+		return "", fmt.Errorf("the key %s was not found in the secret %s/%s", key, namespace, name)
+	}
+
+	return string(val), nil
+}
+
+// fromConfigMap returns the value of key in the ConfigMap named name in namespace.
+func (tc *templateContext) fromConfigMap(namespace, name, key string) (string, error) {
+	if err := tc.resolver.validateLookupNamespace(namespace); err != nil {
+		return "", err
+	}
+
+	cKey := cacheKey{
+		gvk: corev1.SchemeGroupVersion.WithKind("ConfigMap"), namespace: namespace, name: name,
+		representation: typedRepresentation,
+	}
+
+	obj, err := tc.getOrFetch(cKey, func() (interface{}, error) {
+		kubeClient := *tc.resolver.kubeClient
+
+		return kubeClient.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	})
+	if err != nil {
+		return "", fmt.Errorf(
+			"failed to get the config map %s/%s: %w", namespace, name, classifyAPIResourceErr(err, false),
+		)
+	}
+
+	cm, _ := obj.(*corev1.ConfigMap)
+
+	val, ok := cm.Data[key]
+	if !ok {
+		return "", fmt.Errorf("the key %s was not found in the config map %s/%s", key, namespace, name)
+	}
+
+	return val, nil
+}
+
+// fromClusterClaim returns the value of the ClusterClaim named name. ClusterClaims are
+// cluster-scoped, so there is no namespace to restrict.
+func (tc *templateContext) fromClusterClaim(name string) (string, error) {
+	cKey := cacheKey{gvk: clusterClaimGVK, name: name, representation: unstructuredRepresentation}
+
+	obj, err := tc.getOrFetch(cKey, func() (interface{}, error) {
+		mapping, err := tc.restMapping(clusterClaimGVK)
+		if err != nil {
+			return nil, err
+		}
+
+		dynamicClient, err := dynamic.NewForConfig(tc.resolver.kubeConfig)
+		if err != nil {
+			return nil, err // nolint:wrapcheck
+		}
+
+		return dynamicClient.Resource(mapping.Resource).Get(context.TODO(), name, metav1.GetOptions{})
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get the cluster claim %s: %w", name, classifyAPIResourceErr(err, false))
+	}
+
+	u, _ := obj.(*unstructured.Unstructured)
+
+	val, _, _ := unstructured.NestedString(u.Object, "spec", "value")
+
+	return val, nil
+}
+
+// lookup returns the object identified by apiVersion, kind, namespace, and name. namespace may be
+// an empty string for a cluster-scoped resource, but is required for a namespace-scoped one.
+func (tc *templateContext) lookup(apiVersion, kind, namespace, name string) (map[string]interface{}, error) {
+	gvk := schema.FromAPIVersionAndKind(apiVersion, kind)
+
+	mapping, err := tc.restMapping(gvk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %s: %w", gvk, classifyAPIResourceErr(err, false))
+	}
+
+	namespaced := mapping.Scope.Name() == meta.RESTScopeNameNamespace
+	if !namespaced {
+		// A cluster-scoped resource has no namespace to restrict, so an empty namespace argument is
+		// expected rather than an error. A non-empty namespace argument must still match
+		// LookupNamespace, and is then ignored.
+		if namespace != "" {
+			if err := tc.resolver.validateLookupNamespace(namespace); err != nil {
+				return nil, err
+			}
+		}
+
+		namespace = ""
+	} else {
+		if namespace == "" {
+			return nil, fmt.Errorf("failed to look up %s %s: %w", kind, name, ErrMissingNamespace)
+		}
+
+		if err := tc.resolver.validateLookupNamespace(namespace); err != nil {
+			return nil, err
+		}
+	}
+
+	cKey := cacheKey{gvk: gvk, namespace: namespace, name: name, representation: unstructuredRepresentation}
+
+	obj, err := tc.getOrFetch(cKey, func() (interface{}, error) {
+		dynamicClient, err := dynamic.NewForConfig(tc.resolver.kubeConfig)
+		if err != nil {
+			return nil, err // nolint:wrapcheck
+		}
+
+		resourceIntf := dynamicClient.Resource(mapping.Resource)
+		if namespaced {
+			return resourceIntf.Namespace(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		}
+
+		return resourceIntf.Get(context.TODO(), name, metav1.GetOptions{})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %s %s: %w", kind, name, classifyAPIResourceErr(err, false))
+	}
+
+	u, _ := obj.(*unstructured.Unstructured)
+
+	return u.Object, nil
+}
+
+// restMapping resolves the REST mapping for gvk via a live discovery call, or directly from
+// Config.KubeAPIResourceList when it's set. Callers within a single ResolveTemplate call should go
+// through templateContext.restMapping instead so that a repeated lookup doesn't pay for discovery
+// more than once.
+func (t *TemplateResolver) restMapping(gvk schema.GroupVersionKind) (*meta.RESTMapping, error) {
+	var groupResources []*restmapper.APIGroupResources
+
+	if t.config.KubeAPIResourceList != nil {
+		groupResources = groupResourcesFromAPIResourceLists(t.config.KubeAPIResourceList)
+	} else {
+		discoveryClient, err := discovery.NewDiscoveryClientForConfig(t.kubeConfig)
+		if err != nil {
+			return nil, err // nolint:wrapcheck
+		}
+
+		groupResources, err = restmapper.GetAPIGroupResources(discoveryClient)
+		if err != nil {
+			return nil, err // nolint:wrapcheck
+		}
+	}
+
+	mapper := restmapper.NewDiscoveryRESTMapper(groupResources)
+
+	return mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+}
+
+// groupResourcesFromAPIResourceLists converts the flat, per-GroupVersion APIResourceList slice
+// (as used by Config.KubeAPIResourceList) into the grouped shape restmapper.NewDiscoveryRESTMapper
+// expects, so that a cached resource list can be used without a live discovery call.
+func groupResourcesFromAPIResourceLists(lists []*metav1.APIResourceList) []*restmapper.APIGroupResources {
+	groups := map[string]*restmapper.APIGroupResources{}
+	order := []string{}
+
+	for _, list := range lists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			continue
+		}
+
+		groupResource, ok := groups[gv.Group]
+		if !ok {
+			groupResource = &restmapper.APIGroupResources{
+				Group:              metav1.APIGroup{Name: gv.Group},
+				VersionedResources: map[string][]metav1.APIResource{},
+			}
+			groups[gv.Group] = groupResource
+			order = append(order, gv.Group)
+		}
+
+		groupResource.Group.Versions = append(
+			groupResource.Group.Versions, metav1.GroupVersionForDiscovery{GroupVersion: list.GroupVersion, Version: gv.Version},
+		)
+		groupResource.VersionedResources[gv.Version] = list.APIResources
+	}
+
+	result := make([]*restmapper.APIGroupResources, 0, len(order))
+	for _, group := range order {
+		result = append(result, groups[group])
+	}
+
+	return result
+}
+
+// warmAPIResourceCache resolves the REST mapping for every literal "lookup" call in templateStr.
+// This is done before template.Parse so that a CRD or core resource that's missing from this
+// cluster is reported as ErrMissingAPIResourceInvalidTemplate, meaning the template itself cannot
+// run on this cluster, rather than only surfacing once a particular field happens to be rendered.
+func (tc *templateContext) warmAPIResourceCache(templateStr string) error {
+	re := literalLookupRe(tc.resolver.config.StartDelim, tc.resolver.config.StopDelim)
+
+	for _, match := range re.FindAllStringSubmatch(templateStr, -1) {
+		gvk := schema.FromAPIVersionAndKind(match[1], match[2])
+
+		if _, err := tc.restMapping(gvk); err != nil {
+			return fmt.Errorf("failed to look up %s: %w", gvk, classifyAPIResourceErr(err, true))
+		}
+	}
+
+	return nil
+}
+
+// classifyAPIResourceErr wraps err with ErrMissingAPIResource (or ErrMissingAPIResourceInvalidTemplate
+// when duringParse is set) when err indicates that a CRD or core API resource isn't registered on
+// the target cluster, so that callers can use errors.Is to distinguish this from other failures. Any
+// other error is returned unchanged.
+func classifyAPIResourceErr(err error, duringParse bool) error {
+	if err == nil {
+		return nil
+	}
+
+	if !meta.IsNoMatchError(err) && !strings.Contains(err.Error(), "the server could not find the requested resource") {
+		return err
+	}
+
+	if duringParse {
+		return fmt.Errorf("%w: %s", ErrMissingAPIResourceInvalidTemplate, err)
+	}
+
+	return fmt.Errorf("%w: %s", ErrMissingAPIResource, err)
+}
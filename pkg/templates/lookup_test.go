@@ -0,0 +1,255 @@
+package templates
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func TestValidateLookupNamespace(t *testing.T) {
+	tests := map[string]struct {
+		lookupNamespace string
+		namespace       string
+		wantErr         bool
+	}{
+		"no restriction, empty namespace":  {"", "", false},
+		"no restriction, any namespace":    {"", "other-ns", false},
+		"restricted, matching namespace":   {"policies", "policies", false},
+		"restricted, mismatched namespace": {"policies", "other-ns", true},
+		"restricted, empty namespace":      {"policies", "", true},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			resolver := &TemplateResolver{config: Config{LookupNamespace: test.lookupNamespace}}
+
+			err := resolver.validateLookupNamespace(test.namespace)
+			if test.wantErr && !errors.Is(err, ErrRestrictedNamespace) {
+				t.Errorf("expected an error wrapping ErrRestrictedNamespace, got %v", err)
+			}
+
+			if !test.wantErr && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+// newNamespaceTestResolver creates a resolver backed by a fake clientset with a single Secret in
+// the "policies" namespace, plus a synthetic KubeAPIResourceList so that restMapping resolves
+// without making a live discovery call.
+func newNamespaceTestResolver(t *testing.T, lookupNamespace string) *TemplateResolver {
+	t.Helper()
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: "policies"},
+		Data:       map[string][]byte{"token": []byte("hunter2")},
+	}
+
+	var kubeClient kubernetes.Interface = fake.NewSimpleClientset(secret)
+
+	apiResourceList := []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "secrets", Kind: "Secret", Namespaced: true},
+			},
+		},
+	}
+
+	resolver, err := NewResolver(&kubeClient, &rest.Config{}, Config{
+		LookupNamespace:     lookupNamespace,
+		KubeAPIResourceList: apiResourceList,
+	})
+	if err != nil {
+		t.Fatalf("failed to create the resolver: %v", err)
+	}
+
+	return resolver
+}
+
+func TestFromSecretNamespaceRestriction(t *testing.T) {
+	resolver := newNamespaceTestResolver(t, "policies")
+	tc := resolver.newTemplateContext()
+
+	if _, err := tc.fromSecret("other-ns", "my-secret", "token"); !errors.Is(err, ErrRestrictedNamespace) {
+		t.Errorf("expected an error wrapping ErrRestrictedNamespace, got %v", err)
+	}
+
+	val, err := tc.fromSecret("policies", "my-secret", "token")
+	if err != nil {
+		t.Fatalf("expected no error for the matching namespace, got %v", err)
+	}
+
+	if val != "hunter2" {
+		t.Errorf("expected hunter2, got %s", val)
+	}
+}
+
+func TestLookupMissingNamespace(t *testing.T) {
+	resolver := newNamespaceTestResolver(t, "")
+	tc := resolver.newTemplateContext()
+
+	_, err := tc.lookup("v1", "Secret", "", "my-secret")
+	if !errors.Is(err, ErrMissingNamespace) {
+		t.Errorf("expected an error wrapping ErrMissingNamespace, got %v", err)
+	}
+}
+
+func TestLookupNamespaceRestriction(t *testing.T) {
+	resolver := newNamespaceTestResolver(t, "policies")
+	tc := resolver.newTemplateContext()
+
+	_, err := tc.lookup("v1", "Secret", "other-ns", "my-secret")
+	if !errors.Is(err, ErrRestrictedNamespace) {
+		t.Errorf("expected an error wrapping ErrRestrictedNamespace, got %v", err)
+	}
+}
+
+// TestFromSecretThenLookupDoesNotShareCacheEntry reproduces a cache collision where fromSecret and
+// lookup resolved the same GVK/namespace/name to the same cache key despite storing incompatible
+// concrete types (*corev1.Secret vs. *unstructured.Unstructured). Calling fromSecret first used to
+// poison the cache entry that the following lookup call for the same Secret would then read back
+// and fail to type-assert, panicking with a nil pointer dereference instead of returning an error.
+func TestFromSecretThenLookupDoesNotShareCacheEntry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(
+			w,
+			`{"apiVersion":"v1","kind":"Secret","metadata":{"name":"my-secret","namespace":"policies"},`+
+				`"data":{"token":"aHVudGVyMg=="}}`,
+		)
+	}))
+	t.Cleanup(server.Close)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: "policies"},
+		Data:       map[string][]byte{"token": []byte("hunter2")},
+	}
+
+	var kubeClient kubernetes.Interface = fake.NewSimpleClientset(secret)
+
+	apiResourceList := []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "secrets", Kind: "Secret", Namespaced: true},
+			},
+		},
+	}
+
+	resolver, err := NewResolver(&kubeClient, &rest.Config{Host: server.URL}, Config{
+		KubeAPIResourceList: apiResourceList,
+	})
+	if err != nil {
+		t.Fatalf("failed to create the resolver: %v", err)
+	}
+
+	tc := resolver.newTemplateContext()
+
+	if _, err := tc.fromSecret("policies", "my-secret", "token"); err != nil {
+		t.Fatalf("failed to get the secret via fromSecret: %v", err)
+	}
+
+	obj, err := tc.lookup("v1", "Secret", "policies", "my-secret")
+	if err != nil {
+		t.Fatalf("expected lookup to succeed after fromSecret cached the same object, got %v", err)
+	}
+
+	objName, _, _ := unstructured.NestedString(obj, "metadata", "name")
+	if objName != "my-secret" {
+		t.Errorf("expected my-secret, got %s", objName)
+	}
+}
+
+// TestWarmAPIResourceCacheIgnoresPlainData reproduces a false positive where literalLookupRe matched
+// lookup-shaped text inside an ordinary data value (i.e. outside any template action), causing
+// warmAPIResourceCache to try to resolve a bogus REST mapping and fail the whole ResolveTemplate
+// call even though no template action was ever present.
+func TestWarmAPIResourceCacheIgnoresPlainData(t *testing.T) {
+	resolver := newTestResolver(t, Config{})
+
+	input := map[string]string{
+		"description": `please lookup "v1" "FooBar" for more info`,
+	}
+
+	output := resolve(t, resolver, input)
+
+	if output["description"] != input["description"] {
+		t.Errorf("expected the plain data value to be left unchanged, got %s", output["description"])
+	}
+}
+
+// newClusterScopedTestResolver creates a resolver backed by an httptest server that serves a single
+// cluster-scoped "Widget" object, plus a synthetic KubeAPIResourceList marking it as Namespaced:
+// false, so that a cluster-scoped lookup can be exercised end-to-end without a real API server.
+func newClusterScopedTestResolver(t *testing.T, lookupNamespace string) *TemplateResolver {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"apiVersion":"config.example.com/v1","kind":"Widget","metadata":{"name":"my-widget"}}`)
+	}))
+	t.Cleanup(server.Close)
+
+	var kubeClient kubernetes.Interface = fake.NewSimpleClientset()
+
+	apiResourceList := []*metav1.APIResourceList{
+		{
+			GroupVersion: "config.example.com/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "widgets", Kind: "Widget", Namespaced: false},
+			},
+		},
+	}
+
+	resolver, err := NewResolver(&kubeClient, &rest.Config{Host: server.URL}, Config{
+		LookupNamespace:     lookupNamespace,
+		KubeAPIResourceList: apiResourceList,
+	})
+	if err != nil {
+		t.Fatalf("failed to create the resolver: %v", err)
+	}
+
+	return resolver
+}
+
+// TestLookupClusterScopedAllowsEmptyNamespace covers a cluster-scoped lookup both with no
+// LookupNamespace restriction and with one in place, since a cluster-scoped resource has no
+// namespace to restrict and must be allowed through with an empty namespace argument either way.
+func TestLookupClusterScopedAllowsEmptyNamespace(t *testing.T) {
+	tests := map[string]string{
+		"no LookupNamespace restriction":       "",
+		"LookupNamespace restriction in place": "policies",
+	}
+
+	for name, lookupNamespace := range tests {
+		lookupNamespace := lookupNamespace
+
+		t.Run(name, func(t *testing.T) {
+			resolver := newClusterScopedTestResolver(t, lookupNamespace)
+			tc := resolver.newTemplateContext()
+
+			obj, err := tc.lookup("config.example.com/v1", "Widget", "", "my-widget")
+			if err != nil {
+				t.Fatalf("expected the cluster-scoped lookup to succeed, got %v", err)
+			}
+
+			objName, _, _ := unstructured.NestedString(obj, "metadata", "name")
+			if objName != "my-widget" {
+				t.Errorf("expected my-widget, got %s", objName)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ package templates
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,6 +16,7 @@ import (
 	"strings"
 	"text/template"
 
+	"github.com/Masterminds/sprig/v3"
 	"github.com/golang/glog"
 	"github.com/spf13/cast"
 	"gopkg.in/yaml.v3"
@@ -29,9 +31,19 @@ const (
 	IVSize            = 16 // Size in bytes
 	glogDefLvl        = 2
 	protectedPrefix   = "$ocm_encrypted:"
+	// protectedPrefixV2 marks a value encrypted with a random, per-value initialization vector
+	// (i.e. Config.RandomIV) rather than the single Config.InitializationVector shared by every
+	// "protect" call.
+	protectedPrefixV2 = "$ocm_encrypted_v2:"
 	yamlIndentation   = 2
 )
 
+// sandboxedFunctions is the list of Sprig functions that can access the environment of the process
+// running the template resolution or perform DNS lookups. They are always removed from the Sprig
+// function map regardless of the DisabledFunctions configuration since they would otherwise allow a
+// policy template to escape the sandbox it's meant to run in.
+var sandboxedFunctions = []string{"env", "expandenv", "getHostByName"}
+
 type EncryptionMode uint8
 
 const (
@@ -48,10 +60,28 @@ var (
 	ErrAESKeyNotSet          = errors.New("AESKey must be set to use this encryption mode")
 	ErrInvalidAESKey         = errors.New("the AES key is invalid")
 	ErrInvalidB64OfEncrypted = errors.New("the encrypted string is invalid base64")
+	ErrInvalidContextType    = errors.New("the input context has an invalid type")
 	// nolint: golint
 	ErrInvalidIV           = errors.New("InitializationVector must be 128 bits")
 	ErrInvalidPKCS7Padding = errors.New("invalid PCKS7 padding")
 	ErrProtectNotEnabled   = errors.New("the protect template function is not enabled in this mode")
+	ErrNewLinesNotAllowed  = errors.New("the input to toLiteral must not contain any newlines")
+	// ErrMissingAPIResource is returned when a lookup, fromSecret, fromConfigMap, or
+	// fromClusterClaim call fails at template execution time because the target cluster doesn't
+	// have the referenced CRD or core API resource registered.
+	ErrMissingAPIResource = errors.New("the Kubernetes API resource could not be found on the cluster")
+	// ErrMissingAPIResourceInvalidTemplate is the ErrMissingAPIResource variant returned when the
+	// missing API resource was detected before template execution began, which means the template
+	// cannot run on this cluster at all rather than just this particular invocation failing.
+	ErrMissingAPIResourceInvalidTemplate = errors.New(
+		"the Kubernetes API resource used in the template could not be found on the cluster",
+	)
+	// ErrRestrictedNamespace is returned when Config.LookupNamespace is set and a lookup function is
+	// called with a different namespace.
+	ErrRestrictedNamespace = errors.New("the namespace argument does not match the configured LookupNamespace")
+	// ErrMissingNamespace is returned when "lookup" is called for a namespace-scoped resource without
+	// a namespace argument.
+	ErrMissingNamespace = errors.New("the namespace argument is required to look up a namespace-scoped resource")
 )
 
 // Config is a struct containing configuration for the API. Some are required.
@@ -67,6 +97,11 @@ var (
 // setting this value is the equivalent of setting this to 1, which means no concurrency.
 //
 // - DisabledFunctions is a slice of default template function names that should be disabled.
+//
+// - DisableResourceCache disables the per-ResolveTemplate cache of objects fetched by fromSecret,
+// fromConfigMap, fromClusterClaim, and lookup. The cache is enabled by default to deduplicate
+// repeated API calls for the same object within a single ResolveTemplate call.
+//
 // - KubeAPIResourceList sets the cache for the Kubernetes API resources. If this is
 // set, template processing will not try to rediscover the Kubernetes API resources
 // needed for dynamic client/ GVK lookups.
@@ -82,7 +117,14 @@ var (
 // yield the same encrypted value in the template.
 //
 // - LookupNamespace is the namespace to restrict "lookup" template functions (e.g. fromConfigMap)
-// to. If this is not set (i.e. an empty string), then all namespaces can be used.
+// to. If this is not set (i.e. an empty string), then all namespaces can be used. A call to
+// fromSecret, fromConfigMap, or lookup with a different namespace argument fails with
+// ErrRestrictedNamespace.
+//
+// - RandomIV enables generating a fresh initialization vector from crypto/rand for each "protect"
+// call instead of reusing InitializationVector for all of them. This avoids identical plaintexts
+// encrypting to identical ciphertexts. Values encrypted under InitializationVector, from before this
+// was enabled, can still be decrypted.
 //
 // - StartDelim customizes the start delimiter used to distinguish a template action. This defaults
 // to "{{". If StopDelim is set, this must also be set.
@@ -94,10 +136,12 @@ type Config struct {
 	AESKey                []byte
 	DecryptionConcurrency uint8
 	DisabledFunctions     []string
+	DisableResourceCache  bool
 	EncryptionMode        EncryptionMode
 	InitializationVector  []byte
 	KubeAPIResourceList   []*metav1.APIResourceList
 	LookupNamespace       string
+	RandomIV              bool
 	StartDelim            string
 	StopDelim             string
 }
@@ -175,10 +219,10 @@ func HasTemplate(template []byte, startDelim string, checkForEncrypted bool) boo
 	return hasTemplate
 }
 
-// getValidContext takes an input context struct with string fields and
+// getValidContext takes an input context struct with string or map[string]string fields and
 // validates it. If is is valid, the context will be returned as is. If the
 // input context is nil, an empty struct will be returned. If it's not valid, an
-// error will be returned.
+// error wrapping ErrInvalidContextType will be returned.
 func getValidContext(context interface{}) (ctx interface{}, _ error) {
 	var ctxType reflect.Type
 
@@ -190,13 +234,28 @@ func getValidContext(context interface{}) (ctx interface{}, _ error) {
 
 	ctxType = reflect.TypeOf(context)
 	if ctxType.Kind() != reflect.Struct {
-		return nil, fmt.Errorf("the input context must be a struct with string fields, got %s", ctxType)
+		return nil, fmt.Errorf("the input context must be a struct, got %s: %w", ctxType, ErrInvalidContextType)
 	}
 
 	for i := 0; i < ctxType.NumField(); i++ {
 		f := ctxType.Field(i)
-		if f.Type.Kind() != reflect.String {
-			return nil, errors.New("the input context must be a struct with string fields")
+
+		switch f.Type.Kind() {
+		case reflect.String:
+			continue
+		case reflect.Map:
+			if f.Type.Key().Kind() == reflect.String && f.Type.Elem().Kind() == reflect.String {
+				continue
+			}
+
+			return nil, fmt.Errorf(
+				"the input context field %s must be a map[string]string, got %s: %w", f.Name, f.Type, ErrInvalidContextType,
+			)
+		default:
+			return nil, fmt.Errorf(
+				"the input context field %s must be a string or map[string]string, got %s: %w",
+				f.Name, f.Type, ErrInvalidContextType,
+			)
 		}
 	}
 
@@ -204,10 +263,12 @@ func getValidContext(context interface{}) (ctx interface{}, _ error) {
 }
 
 // ResolveTemplate accepts a map marshaled as JSON. It also accepts a struct
-// with string fields that will be made available when the template is processed.
-// For example, if the argument is `struct{ClusterName string}{"cluster1"}`,
-// the value `cluster1` would be available with `{{ .ClusterName }}`. This can
-// also be `nil` if no fields should be made available.
+// with string or map[string]string fields that will be made available when the template is
+// processed. For example, if the argument is `struct{ClusterName string}{"cluster1"}`,
+// the value `cluster1` would be available with `{{ .ClusterName }}`. A map[string]string field,
+// such as `struct{ClusterLabels map[string]string}{map[string]string{"env": "dev"}}`, is available
+// with `{{ index .ClusterLabels "env" }}`. This can also be `nil` if no fields should be made
+// available. Any other field type results in an error wrapping ErrInvalidContextType.
 //
 // ResolveTemplate will process any template strings in the map and return the processed map.
 func (t *TemplateResolver) ResolveTemplate(tmplJSON []byte, context interface{}) ([]byte, error) {
@@ -218,23 +279,36 @@ func (t *TemplateResolver) ResolveTemplate(tmplJSON []byte, context interface{})
 		return []byte(""), err
 	}
 
-	// Build Map of supported template functions
-	funcMap := template.FuncMap{
-		"fromSecret":       t.fromSecret,
-		"fromConfigMap":    t.fromConfigMap,
-		"fromClusterClaim": t.fromClusterClaim,
-		"lookup":           t.lookup,
-		"base64enc":        base64encode,
-		"base64dec":        base64decode,
-		"autoindent":       autoindent,
-		"indent":           t.indent,
-		"atoi":             atoi,
-		"toInt":            toInt,
-		"toBool":           toBool,
+	// Start with the Sprig function library so that users get the full ecosystem of string, list,
+	// date, math, regex, dict, and encoding helpers. The functions in sandboxedFunctions are removed
+	// unconditionally since they would let a policy template read the environment of the process
+	// or perform DNS lookups.
+	funcMap := sprig.TxtFuncMap()
+	for _, funcName := range sandboxedFunctions {
+		delete(funcMap, funcName)
 	}
 
+	// tc scopes the resource cache to this single ResolveTemplate call; it must not be reused across
+	// calls since the resolver is shared and the cached results are time-sensitive.
+	tc := t.newTemplateContext()
+
+	// Layer the functions specific to this package on top of Sprig. These take precedence over any
+	// same-named Sprig function.
+	funcMap["fromSecret"] = tc.fromSecret
+	funcMap["fromConfigMap"] = tc.fromConfigMap
+	funcMap["fromClusterClaim"] = tc.fromClusterClaim
+	funcMap["lookup"] = tc.lookup
+	funcMap["base64enc"] = base64encode
+	funcMap["base64dec"] = base64decode
+	funcMap["autoindent"] = autoindent
+	funcMap["indent"] = t.indent
+	funcMap["atoi"] = atoi
+	funcMap["toInt"] = toInt
+	funcMap["toBool"] = toBool
+	funcMap["toLiteral"] = toLiteral
+
 	if t.config.EncryptionMode == EncryptionEnabled {
-		funcMap["fromSecret"] = t.fromSecretProtected
+		funcMap["fromSecret"] = tc.fromSecretProtected
 		funcMap["protect"] = t.protect
 	} else {
 		// In other encryption modes, return a readable error if the protect template function is accidentally used.
@@ -264,8 +338,9 @@ func (t *TemplateResolver) ResolveTemplate(tmplJSON []byte, context interface{})
 		}
 	}
 
-	// process for int or bool
-	if strings.Contains(templateStr, "toInt") || strings.Contains(templateStr, "toBool") {
+	// process for int, bool, or literal
+	if strings.Contains(templateStr, "toInt") || strings.Contains(templateStr, "toBool") ||
+		strings.Contains(templateStr, "toLiteral") {
 		templateStr = t.processForDataTypes(templateStr)
 	}
 
@@ -274,6 +349,14 @@ func (t *TemplateResolver) ResolveTemplate(tmplJSON []byte, context interface{})
 		templateStr = t.processForAutoIndent(templateStr)
 	}
 
+	// Pre-resolve the REST mapping of every literal "lookup" call so that a CRD or core resource
+	// that's missing from this cluster is reported before template execution even starts.
+	if strings.Contains(templateStr, "lookup") {
+		if err := tc.warmAPIResourceCache(templateStr); err != nil {
+			return []byte(""), fmt.Errorf("failed to parse the template JSON string %v: %w", string(tmplJSON), err)
+		}
+	}
+
 	tmpl, err = tmpl.Parse(templateStr)
 	if err != nil {
 		tmplJSONStr := string(tmplJSON)
@@ -317,10 +400,12 @@ func (t *TemplateResolver) processForDataTypes(str string) string {
 	// ex-1 key : "{{ "6" | toInt }}"  .. is replaced with  key : {{ "6" | toInt }}
 	// ex-2 key : |
 	//						"{{ "true" | toBool }}" .. is replaced with key : {{ "true" | toBool }}
+	// toLiteral is handled the same way so that the rendered value is emitted as a raw YAML scalar
+	// instead of being forced into a string by the surrounding quotes.
 	d1 := regexp.QuoteMeta(t.config.StartDelim)
 	d2 := regexp.QuoteMeta(t.config.StopDelim)
 	re := regexp.MustCompile(
-		`:\s+(?:[\|>][-]?\s+)?(?:['|"]\s*)?(` + d1 + `.*?\s+\|\s+(?:toInt|toBool)\s*` + d2 + `)(?:\s*['|"])?`,
+		`:\s+(?:[\|>][-]?\s+)?(?:['|"]\s*)?(` + d1 + `.*?\s+\|\s+(?:toInt|toBool|toLiteral)\s*` + d2 + `)(?:\s*['|"])?`,
 	)
 	glog.V(glogDefLvl).Infof("\n Pattern: %v\n", re.String())
 
@@ -367,9 +452,14 @@ func (t *TemplateResolver) processForAutoIndent(str string) string {
 // concurrently and the concurrency limit is controlled by t.config.DecryptionConcurrency. If a decryption fails,
 // the rest of the decryption is halted and an error is returned.
 func (t *TemplateResolver) processEncryptedStrs(templateStr string) (string, error) {
-	// This catching any encrypted string in the format of $ocm_encrypted:<base64 of the encrypted value>.
-	re := regexp.MustCompile(regexp.QuoteMeta(protectedPrefix) + "([a-zA-Z0-9+/=]+)")
-	// Each submatch will have index 0 be the whole match and index 1 as the base64 of the encrypted value.
+	// This catches any encrypted string in the legacy format of
+	// $ocm_encrypted:<base64 of the encrypted value>, or in the random IV format of
+	// $ocm_encrypted_v2:<base64 of the IV prepended to the encrypted value>.
+	re := regexp.MustCompile(
+		regexp.QuoteMeta(protectedPrefixV2) + "([a-zA-Z0-9+/=]+)" + "|" + regexp.QuoteMeta(protectedPrefix) + "([a-zA-Z0-9+/=]+)",
+	)
+	// Each submatch will have index 0 be the whole match, index 1 the base64 payload if it matched
+	// the random IV format, and index 2 the base64 payload if it matched the legacy format.
 	submatches := re.FindAllStringSubmatch(templateStr, -1)
 
 	if len(submatches) == 0 {
@@ -445,18 +535,25 @@ type decryptResult struct {
 
 // decryptWrapper wraps the decrypt method for concurrency. ctx is the context that will get canceled if one or more
 // decryptions fail. This will halt the Goroutine early. submatches is the channel with the incoming strings to decrypt
-// which gets closed when all the encrypted values have been decrypted. Its values are string slices with the first
-// index being the whole string that will be replaced and second index being the base64 of the encrypted string. results
+// which gets closed when all the encrypted values have been decrypted. Its values are string slices as produced by the
+// regular expression in processEncryptedStrs: index 0 is the whole string that will be replaced, index 1 is the
+// base64 payload if it's the random IV format, and index 2 is the base64 payload if it's the legacy format. results
 // is a channel to communicate back to the calling Goroutine.
 func (t *TemplateResolver) decryptWrapper(
 	ctx context.Context, submatches <-chan []string, results chan<- decryptResult,
 ) {
 	for submatch := range submatches {
 		match := submatch[0]
-		encryptedValue := submatch[1]
+		isRandomIV := submatch[1] != ""
+
+		encryptedValue := submatch[2]
+		if isRandomIV {
+			encryptedValue = submatch[1]
+		}
+
 		var result decryptResult
 
-		plaintext, err := t.decrypt(encryptedValue)
+		plaintext, err := t.decrypt(encryptedValue, isRandomIV)
 		if err != nil {
 			result = decryptResult{match, "", err}
 		} else {
@@ -540,3 +637,29 @@ func toBool(a string) bool {
 
 	return b
 }
+
+func base64encode(v string) string {
+	return base64.StdEncoding.EncodeToString([]byte(v))
+}
+
+func base64decode(v string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return "", fmt.Errorf("failed to base64 decode the input: %w", err)
+	}
+
+	return string(decoded), nil
+}
+
+// toLiteral returns v unchanged. It's meant to be used with processForDataTypes, which strips the
+// surrounding quotes that the YAML marshaller would otherwise put around the rendered value, so
+// that the result is emitted as a raw YAML scalar (e.g. an integer, a boolean, null, a list, or a
+// key name) instead of a string. Since an unquoted multi-line scalar would break the surrounding
+// YAML structure, newlines in v are rejected.
+func toLiteral(v string) (string, error) {
+	if strings.Contains(v, "\n") {
+		return "", ErrNewLinesNotAllowed
+	}
+
+	return v, nil
+}
@@ -0,0 +1,69 @@
+package templates
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGetValidContext(t *testing.T) {
+	tests := map[string]struct {
+		context interface{}
+		wantErr bool
+	}{
+		"nil context": {
+			context: nil,
+			wantErr: false,
+		},
+		"string fields only": {
+			context: struct{ ClusterName string }{"cluster1"},
+			wantErr: false,
+		},
+		"map[string]string field": {
+			context: struct {
+				ClusterLabels map[string]string
+			}{map[string]string{"env": "dev"}},
+			wantErr: false,
+		},
+		"mixed string and map[string]string fields": {
+			context: struct {
+				ClusterName   string
+				ClusterLabels map[string]string
+			}{"cluster1", map[string]string{"env": "dev"}},
+			wantErr: false,
+		},
+		"not a struct": {
+			context: "cluster1",
+			wantErr: true,
+		},
+		"slice field": {
+			context: struct{ ClusterNames []string }{[]string{"cluster1"}},
+			wantErr: true,
+		},
+		"map[string]int field": {
+			context: struct {
+				ClusterCounts map[string]int
+			}{map[string]int{"env": 1}},
+			wantErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			_, err := getValidContext(test.context)
+
+			if test.wantErr {
+				if !errors.Is(err, ErrInvalidContextType) {
+					t.Errorf("expected an error wrapping ErrInvalidContextType, got %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+		})
+	}
+}
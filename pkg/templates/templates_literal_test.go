@@ -0,0 +1,52 @@
+package templates
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestResolveTemplateToLiteral(t *testing.T) {
+	resolver := newTestResolver(t, Config{})
+
+	tests := map[string]struct {
+		input    string
+		expected string
+	}{
+		"integer list": {
+			input:    `{"key": "{{ \"[1,2,3]\" | toLiteral }}"}`,
+			expected: `{"key":[1,2,3]}`,
+		},
+		"boolean": {
+			input:    `{"key": "{{ \"true\" | toLiteral }}"}`,
+			expected: `{"key":true}`,
+		},
+		"object key": {
+			input:    `{"{{ \"dynamic-key\" | toLiteral }}": "value"}`,
+			expected: `{"dynamic-key":"value"}`,
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			output, err := resolver.ResolveTemplate([]byte(test.input), nil)
+			if err != nil {
+				t.Fatalf("failed to resolve the template: %v", err)
+			}
+
+			if string(output) != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, string(output))
+			}
+		})
+	}
+}
+
+func TestToLiteralRejectsNewlines(t *testing.T) {
+	resolver := newTestResolver(t, Config{})
+
+	_, err := resolver.ResolveTemplate([]byte(`{"key": "{{ \"a\\nb\" | toLiteral }}"}`), nil)
+	if !errors.Is(err, ErrNewLinesNotAllowed) {
+		t.Errorf("expected an error wrapping ErrNewLinesNotAllowed, got %v", err)
+	}
+}
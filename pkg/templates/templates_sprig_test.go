@@ -0,0 +1,127 @@
+package templates
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func newTestResolver(t *testing.T, config Config) *TemplateResolver {
+	t.Helper()
+
+	var kubeClient kubernetes.Interface = fake.NewSimpleClientset()
+
+	resolver, err := NewResolver(&kubeClient, &rest.Config{}, config)
+	if err != nil {
+		t.Fatalf("failed to create the resolver: %v", err)
+	}
+
+	return resolver
+}
+
+func resolve(t *testing.T, resolver *TemplateResolver, input map[string]string) map[string]string {
+	t.Helper()
+
+	inputJSON, err := json.Marshal(input)
+	if err != nil {
+		t.Fatalf("failed to marshal the input: %v", err)
+	}
+
+	outputJSON, err := resolver.ResolveTemplate(inputJSON, nil)
+	if err != nil {
+		t.Fatalf("failed to resolve the template: %v", err)
+	}
+
+	output := map[string]string{}
+	if err := json.Unmarshal(outputJSON, &output); err != nil {
+		t.Fatalf("failed to unmarshal the output %s: %v", outputJSON, err)
+	}
+
+	return output
+}
+
+func TestResolveTemplateSprigFunctions(t *testing.T) {
+	resolver := newTestResolver(t, Config{})
+
+	output := resolve(t, resolver, map[string]string{"key": `{{ "  hello  " | trim | upper }}`})
+
+	if output["key"] != "HELLO" {
+		t.Errorf("expected HELLO, got %s", output["key"])
+	}
+}
+
+func TestResolveTemplateSprigSandboxedFunctions(t *testing.T) {
+	resolver := newTestResolver(t, Config{})
+
+	_, err := resolver.ResolveTemplate([]byte(`{"key": "{{ env \"HOME\" }}"}`), nil)
+	if err == nil {
+		t.Fatal("expected an error since env is sandboxed, got nil")
+	}
+}
+
+func TestResolveTemplateSprigWithProtect(t *testing.T) {
+	aesKey := []byte("0123456789abcdef")
+	iv := []byte("abcdefghijklmnop")
+
+	resolver := newTestResolver(t, Config{
+		EncryptionMode:       EncryptionEnabled,
+		AESKey:               aesKey,
+		InitializationVector: iv,
+	})
+
+	output := resolve(t, resolver, map[string]string{"key": `{{ "hello" | upper | protect }}`})
+
+	if !strings.HasPrefix(output["key"], protectedPrefix) {
+		t.Errorf("expected the value to be protected, got %s", output["key"])
+	}
+}
+
+func TestResolveTemplateSprigWithFromSecretAndProtect(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: "policies"},
+		Data:       map[string][]byte{"token": []byte(" hunter2 ")},
+	}
+
+	var kubeClient kubernetes.Interface = fake.NewSimpleClientset(secret)
+
+	resolver, err := NewResolver(&kubeClient, &rest.Config{}, Config{
+		EncryptionMode:       EncryptionEnabled,
+		AESKey:               []byte("0123456789abcdef"),
+		InitializationVector: []byte("abcdefghijklmnop"),
+	})
+	if err != nil {
+		t.Fatalf("failed to create the resolver: %v", err)
+	}
+
+	output := resolve(
+		t, resolver, map[string]string{"key": `{{ fromSecret "policies" "my-secret" "token" | trim | protect }}`},
+	)
+
+	if !strings.HasPrefix(output["key"], protectedPrefix) {
+		t.Errorf("expected the trimmed secret value to be protected, got %s", output["key"])
+	}
+}
+
+func TestResolveTemplateSprigWithAutoindent(t *testing.T) {
+	resolver := newTestResolver(t, Config{})
+
+	output, err := resolver.ResolveTemplate([]byte(`{"config": "{{ \"hello\\nworld\" | upper | autoindent }}"}`), nil)
+	if err != nil {
+		t.Fatalf("failed to resolve the template: %v", err)
+	}
+
+	result := map[string]string{}
+	if err := json.Unmarshal(output, &result); err != nil {
+		t.Fatalf("failed to unmarshal the output %s: %v", output, err)
+	}
+
+	if !strings.Contains(result["config"], "HELLO") || !strings.Contains(result["config"], "WORLD") {
+		t.Errorf("expected the autoindented value to contain the upper-cased lines, got %q", result["config"])
+	}
+}